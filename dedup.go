@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/hex"
+	"image"
+	"os"
+
+	"github.com/t8y2/datacomp-crawl/dedup"
+)
+
+// DedupConfig 控制内容去重：精确的 sha256 匹配总是在 Enabled 时生效，
+// PHashHammingDistance 额外开启感知哈希近似去重（0 表示关闭）
+type DedupConfig struct {
+	Enabled              bool   `yaml:"enabled" mapstructure:"enabled"`
+	DBPath               string `yaml:"db_path" mapstructure:"db_path"`
+	PHashHammingDistance int    `yaml:"phash_hamming_distance" mapstructure:"phash_hamming_distance"`
+}
+
+var (
+	dedupStore    *dedup.Store          // 跨分片共享的 sha256/phash 索引
+	dedupManifest *dedup.ManifestWriter // 当前分片的 manifest.jsonl 写入器
+)
+
+// openDedupStore 在 Dedup.Enabled 时打开全局去重索引，失败则直接退出，和其它初始化失败的处理方式一致
+func openDedupStore() {
+	if !config.Dedup.Enabled {
+		return
+	}
+	store, err := dedup.Open(config.Dedup.DBPath)
+	if err != nil {
+		panic(err)
+	}
+	dedupStore = store
+}
+
+// dedupCheck 对刚落盘的本地文件做内容去重：先比对 sha256 精确匹配，再按配置比对感知哈希近似匹配，
+// 命中任意一种则把刚写的文件换成指向已有文件的符号链接，否则把两种哈希都记入索引
+func dedupCheck(url, fullPath string, sum []byte) error {
+	if dedupStore == nil {
+		return nil
+	}
+	sumHex := hex.EncodeToString(sum)
+
+	if existing, found, err := dedupStore.LookupSHA256(sumHex); err != nil {
+		return err
+	} else if found && existing != fullPath {
+		return replaceWithSymlink(url, fullPath, existing, sumHex, 0)
+	}
+
+	phash, err := computeFilePHash(fullPath)
+	if err != nil {
+		// 感知哈希计算失败不影响已经落盘的文件，只是这张图不参与近似去重索引
+		appendManifest(url, sumHex, 0, fullPath, false)
+		return dedupStore.PutSHA256(sumHex, fullPath)
+	}
+
+	if config.Dedup.PHashHammingDistance > 0 {
+		if existing, found, err := dedupStore.LookupNearPHash(phash, config.Dedup.PHashHammingDistance); err != nil {
+			return err
+		} else if found && existing != fullPath {
+			return replaceWithSymlink(url, fullPath, existing, sumHex, phash)
+		}
+	}
+
+	if err := dedupStore.PutSHA256(sumHex, fullPath); err != nil {
+		return err
+	}
+	if err := dedupStore.PutPHash(phash, fullPath); err != nil {
+		return err
+	}
+	appendManifest(url, sumHex, phash, fullPath, false)
+	return nil
+}
+
+// replaceWithSymlink 删掉刚写入的重复文件，换成指向已有文件的符号链接，并在 manifest 里标记 duplicate
+func replaceWithSymlink(url, fullPath, target, sumHex string, phash uint64) error {
+	if err := os.Remove(fullPath); err != nil {
+		return err
+	}
+	if err := os.Symlink(target, fullPath); err != nil {
+		return err
+	}
+	appendManifest(url, sumHex, phash, fullPath, true)
+	return nil
+}
+
+// dedupCheckRemote 对已经上传到存储后端（S3/OSS/tar 分片包）的对象做内容去重：只比对 sha256 精确匹配。
+// 感知哈希近似去重需要解码完整像素，而后端路径是边流式上传边算哈希，上传完成时内容已经不在本地、
+// 也没有缓冲整份内容供解码，所以近似去重仍然只在本地磁盘路径（dedupCheck）下提供，这里只做精确去重。
+// 后端没有通用的删除/拷贝操作，命中重复时无法像本地那样换成符号链接，只能在 manifest 里记录重复关系，
+// 对象本身仍然留在后端（带宽已经花掉，省的是下游消费者看到两份内容时要做的去重工作）。
+func dedupCheckRemote(url, key string, sum []byte) error {
+	if dedupStore == nil {
+		return nil
+	}
+	sumHex := hex.EncodeToString(sum)
+
+	existing, found, err := dedupStore.LookupSHA256(sumHex)
+	if err != nil {
+		return err
+	}
+	if found && existing != key {
+		appendManifest(url, sumHex, 0, existing, true)
+		return nil
+	}
+
+	if err := dedupStore.PutSHA256(sumHex, key); err != nil {
+		return err
+	}
+	appendManifest(url, sumHex, 0, key, false)
+	return nil
+}
+
+// computeFilePHash 重新打开已落盘的文件解码出完整像素，算出 8x8 灰度 aHash 指纹
+func computeFilePHash(fullPath string) (uint64, error) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return 0, err
+	}
+	return dedup.ComputePHash(img), nil
+}
+
+// appendManifest 把一条去重决策写入当前分片的 manifest.jsonl，dedupManifest 为空（未开启去重）时跳过
+func appendManifest(url, sumHex string, phash uint64, storedPath string, duplicate bool) {
+	if dedupManifest == nil {
+		return
+	}
+	_ = dedupManifest.Append(dedup.ManifestEntry{
+		URL:        url,
+		SHA256:     sumHex,
+		PHash:      phash,
+		StoredPath: storedPath,
+		Duplicate:  duplicate,
+	})
+}
@@ -0,0 +1,51 @@
+package dedup
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// ManifestEntry 是 manifest.jsonl 里的一行，记录一次去重决策的完整上下文，
+// 方便下游不依赖 BoltDB 文件也能复原 url -> 落盘路径 的映射
+type ManifestEntry struct {
+	URL        string `json:"url"`
+	SHA256     string `json:"sha256"`
+	PHash      uint64 `json:"phash"`
+	StoredPath string `json:"stored_path"`
+	Duplicate  bool   `json:"duplicate"`
+}
+
+// ManifestWriter 把每条去重决策追加写入一个分片的 manifest.jsonl，多个下载 goroutine 共用同一个实例
+type ManifestWriter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// OpenManifest 以追加模式打开（或新建）path 处的 manifest.jsonl
+func OpenManifest(path string) (*ManifestWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &ManifestWriter{file: f}, nil
+}
+
+// Append 写入一行 manifest 记录
+func (w *ManifestWriter) Append(e ManifestEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err = w.file.Write(data)
+	return err
+}
+
+// Close 关闭底层文件
+func (w *ManifestWriter) Close() error {
+	return w.file.Close()
+}
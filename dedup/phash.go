@@ -0,0 +1,30 @@
+package dedup
+
+import (
+	"image"
+
+	"golang.org/x/image/draw"
+)
+
+// ComputePHash 计算 aHash 指纹：把图片缩放到 8x8 灰度，每个像素与均值比较，
+// 高于等于均值记 1，生成一个 64 位指纹，相近的图片（裁剪、压缩、轻微调色）指纹的汉明距离很小
+func ComputePHash(img image.Image) uint64 {
+	small := image.NewGray(image.Rect(0, 0, 8, 8))
+	draw.BiLinear.Scale(small, small.Bounds(), img, img.Bounds(), draw.Over, nil)
+
+	var sum int
+	pixels := make([]uint8, 64)
+	for i, p := range small.Pix {
+		pixels[i] = p
+		sum += int(p)
+	}
+	mean := sum / len(pixels)
+
+	var hash uint64
+	for i, p := range pixels {
+		if int(p) >= mean {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
@@ -0,0 +1,126 @@
+// Package dedup 提供基于内容的去重索引：sha256 精确匹配 + 感知哈希近似匹配，
+// 外加每个分片的 manifest.jsonl 侧车文件，供下游复原 url -> 落盘文件 的映射。
+package dedup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/bits"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	sha256Bucket    = []byte("sha256")
+	phashBandBucket = []byte("phash_bands")
+)
+
+// phashBands/phashBandBits 把 64 位感知哈希切成若干等宽的“band”，每个 band 单独建一份索引。
+// 对汉明距离 <= maxDistance 的两个哈希，差异比特分布在至多 maxDistance 个 band 里（鸽笼原理），
+// 所以只要 maxDistance < phashBands，就必然存在至少一个完全相同的 band，可以用它做前缀查找，
+// 避免每次近似去重检查都要线性扫过全部历史哈希（该索引是跨分片共享的，数量会随分片处理持续增长）。
+const (
+	phashBands    = 16
+	phashBandBits = 64 / phashBands
+)
+
+// Store 是一个跨分片共享的 BoltDB 去重索引，key 分别是内容哈希和感知哈希，
+// value 统一存已经落盘的 storage key（本地路径或对象存储 key）
+type Store struct {
+	db *bolt.DB
+}
+
+// Open 打开（或新建）dbPath 处的 BoltDB 文件，并确保所需的两个 bucket 存在
+func Open(dbPath string) (*Store, error) {
+	db, err := bolt.Open(dbPath, 0644, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(sha256Bucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(phashBandBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// Close 关闭底层 BoltDB 文件
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// LookupSHA256 查询某个内容哈希是否已经落过盘，命中则返回之前存的 storage key
+func (s *Store) LookupSHA256(sum string) (key string, found bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(sha256Bucket).Get([]byte(sum))
+		if v != nil {
+			key, found = string(v), true
+		}
+		return nil
+	})
+	return key, found, err
+}
+
+// PutSHA256 记录一个新的内容哈希到 storage key 的映射
+func (s *Store) PutSHA256(sum, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sha256Bucket).Put([]byte(sum), []byte(key))
+	})
+}
+
+// bandKey 返回 phash 在第 band 个 band（从最高位起，每 band 占 phashBandBits 位）里的索引 key：
+// 1 字节 band 编号 + 该 band 的位值 + 完整哈希，同一 band 编号+位值的条目在 BoltDB 里前缀相邻，
+// 用 Cursor.Seek 定位后按前缀扫描即可，而不用扫全表。
+func bandKey(band int, phash uint64) []byte {
+	shift := uint(64 - phashBandBits*(band+1))
+	bandValue := byte((phash >> shift) & (1<<phashBandBits - 1))
+	k := make([]byte, 1+1+8)
+	k[0] = byte(band)
+	k[1] = bandValue
+	binary.BigEndian.PutUint64(k[2:], phash)
+	return k
+}
+
+// LookupNearPHash 按 band 前缀查找候选，只在汉明距离 <= maxDistance < phashBands 时保证不漏检
+// （见 phashBands 的注释），返回第一个汉明距离不超过 maxDistance 的已有 storage key。
+func (s *Store) LookupNearPHash(phash uint64, maxDistance int) (key string, found bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(phashBandBucket).Cursor()
+		for band := 0; band < phashBands; band++ {
+			prefix := bandKey(band, phash)[:2]
+			for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				existing := binary.BigEndian.Uint64(k[2:])
+				if hammingDistance(existing, phash) <= maxDistance {
+					key, found = string(v), true
+					return nil
+				}
+			}
+		}
+		return nil
+	})
+	return key, found, err
+}
+
+// PutPHash 把一个新的感知哈希写入所有 band 的索引，映射到同一个 storage key
+func (s *Store) PutPHash(phash uint64, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(phashBandBucket)
+		for band := 0; band < phashBands; band++ {
+			if err := b.Put(bandKey(band, phash), []byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// hammingDistance 返回两个 64 位指纹之间不同的比特数
+func hammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
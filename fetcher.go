@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// chunkRange 记录一个分片的字节区间及完成状态
+type chunkRange struct {
+	Start     int64 `json:"start"`
+	End       int64 `json:"end"`
+	Completed bool  `json:"completed"`
+}
+
+// downloadProgress 是 .part.json 文件的内容，记录某个 URL 的分片下载进度
+type downloadProgress struct {
+	URL    string       `json:"url"`
+	Size   int64        `json:"size"`
+	Chunks []chunkRange `json:"chunks"`
+}
+
+// probeRange 用 Range: bytes=0-0 探测目标是否支持断点续传，并返回文件总大小和声明的 Content-Type
+func probeRange(url string) (size int64, supportsRange bool, contentType string, err error) {
+	resp, err := doWithRetry(url, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Range", "bytes=0-0")
+		return req, nil
+	})
+	if err != nil {
+		return 0, false, "", err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	contentType = resp.Header.Get("Content-Type")
+
+	if resp.StatusCode == http.StatusPartialContent {
+		contentRange := resp.Header.Get("Content-Range")
+		// 格式形如 "bytes 0-0/12345"
+		if idx := strings.LastIndex(contentRange, "/"); idx != -1 {
+			total, convErr := strconv.ParseInt(contentRange[idx+1:], 10, 64)
+			if convErr == nil {
+				return total, true, contentType, nil
+			}
+		}
+		return 0, false, contentType, nil
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		return resp.ContentLength, false, contentType, nil
+	}
+
+	return 0, false, "", fmt.Errorf("探测请求返回非预期状态码: %d", resp.StatusCode)
+}
+
+// partPathFor 返回某个存储路径对应的分片进度侧车文件路径
+func partPathFor(fileStoragePath string) string {
+	return fileStoragePath + ".part.json"
+}
+
+// doneMarkerKey 返回某个 stem 对应的“已完整下载”标记 key。落盘用的扩展名要等内容嗅探完才知道，
+// 没法直接用 stem+ext 去探测是否已经下载过，所以额外维护一个和扩展名无关的标记
+func doneMarkerKey(stem string) string {
+	return stem + ".done"
+}
+
+// alreadyDownloaded 检查某个 URL 对应的对象是否在之前的运行里已经完整落盘过，命中则本次运行跳过重新下载
+func alreadyDownloaded(stem string) bool {
+	exists, err := backend.Exists(context.Background(), doneMarkerKey(stem))
+	return err == nil && exists
+}
+
+// markDownloaded 在对象成功落盘/上传后写一个空的标记文件，记录其最终 key，
+// 供程序中断后重跑同一分片时跳过。只标记成功的对象，被拒绝的响应仍然允许重试（可能只是临时的拦截页）
+func markDownloaded(stem, key string) {
+	if err := backend.Put(context.Background(), doneMarkerKey(stem), strings.NewReader(key), int64(len(key)), nil); err != nil {
+		fmt.Printf("写入完成标记失败: %s - %v\n", stem, err)
+	}
+}
+
+// splitChunks 把 [0, size) 按 connections 等分成若干区间
+func splitChunks(size int64, connections int) []chunkRange {
+	if connections < 1 {
+		connections = 1
+	}
+	chunkSize := size / int64(connections)
+	if chunkSize == 0 {
+		chunkSize = size
+	}
+	var chunks []chunkRange
+	var start int64
+	for start < size {
+		end := start + chunkSize - 1
+		if end >= size-1 || len(chunks) == connections-1 {
+			end = size - 1
+		}
+		chunks = append(chunks, chunkRange{Start: start, End: end})
+		start = end + 1
+	}
+	return chunks
+}
+
+// loadOrInitProgress 读取已有的 .part.json，不存在则按配置新建分片计划
+func loadOrInitProgress(url, partPath string, size int64) *downloadProgress {
+	if data, err := os.ReadFile(partPath); err == nil {
+		var p downloadProgress
+		if json.Unmarshal(data, &p) == nil && p.URL == url && p.Size == size {
+			return &p
+		}
+	}
+	return &downloadProgress{
+		URL:    url,
+		Size:   size,
+		Chunks: splitChunks(size, config.ConnectionsPerFile),
+	}
+}
+
+// saveProgress 把分片进度持久化到侧车文件，用于程序中断后恢复
+func saveProgress(partPath string, p *downloadProgress) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return
+	}
+	_ = os.WriteFile(partPath, data, 0644)
+}
+
+// downloadMultipart 用多个 goroutine 并行拉取各分片，写入预分配的稀疏文件，支持断点续传。
+// 落盘扩展名要等内容嗅探完成才能确定，下载期间先写到 stem 对应的 .tmp 文件，完成后再嗅探、校验、改名。
+func downloadMultipart(url, stem string, size int64, declaredContentType string) error {
+	tmpPath := path.Join(config.StoragePath, stem+".tmp")
+	if err := os.MkdirAll(path.Dir(tmpPath), os.ModePerm); err != nil {
+		return err
+	}
+	partPath := partPathFor(tmpPath)
+	progress := loadOrInitProgress(url, partPath, size)
+
+	out, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := out.Truncate(size); err != nil {
+		out.Close()
+		return err
+	}
+
+	var progressMu sync.Mutex
+	var chunkWg sync.WaitGroup
+	failed := make(chan error, len(progress.Chunks))
+
+	for i := range progress.Chunks {
+		if progress.Chunks[i].Completed {
+			continue
+		}
+		chunkWg.Add(1)
+		go func(idx int) {
+			defer chunkWg.Done()
+			c := progress.Chunks[idx]
+			resp, err := doWithRetry(url, func() (*http.Request, error) {
+				req, err := http.NewRequest(http.MethodGet, url, nil)
+				if err != nil {
+					return nil, err
+				}
+				req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", c.Start, c.End))
+				return req, nil
+			})
+			if err != nil {
+				failed <- err
+				return
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusPartialContent {
+				failed <- fmt.Errorf("分片请求返回非 206 状态码: %d", resp.StatusCode)
+				return
+			}
+			data, err := io.ReadAll(resp.Body)
+			if err != nil {
+				failed <- err
+				return
+			}
+			if _, err := out.WriteAt(data, c.Start); err != nil {
+				failed <- err
+				return
+			}
+
+			progressMu.Lock()
+			progress.Chunks[idx].Completed = true
+			saveProgress(partPath, progress)
+			progressMu.Unlock()
+		}(i)
+	}
+	chunkWg.Wait()
+	close(failed)
+	out.Close()
+
+	for err := range failed {
+		if err != nil {
+			return err
+		}
+	}
+
+	// 所有分片完成后清理侧车文件
+	os.Remove(partPath)
+
+	return finalizeLocalFile(url, tmpPath, stem, declaredContentType, size)
+}
+
+// finalizeLocalFile 对已经下载完的临时文件做内容嗅探和解码校验，通过则改名为带正确扩展名的最终文件，
+// 否则移动到 rejected/ 目录并带上原因标签
+func finalizeLocalFile(url, tmpPath, stem, declaredContentType string, size int64) error {
+	f, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	head, err := readHead(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	result := inspectImage(head, declaredContentType, size)
+	if !result.accepted {
+		rejPath := rejectedPath(stem, result.reason)
+		if err := os.MkdirAll(path.Dir(rejPath), os.ModePerm); err != nil {
+			return err
+		}
+		if err := os.Rename(tmpPath, rejPath); err != nil {
+			return err
+		}
+		recordOutcome(result.reason, 0)
+		return nil
+	}
+
+	finalPath := path.Join(config.StoragePath, stem+result.ext)
+	if err := os.Rename(tmpPath, finalPath); err != nil {
+		return err
+	}
+	recordSuccess(url, size)
+	markDownloaded(stem, stem+result.ext)
+
+	if sum, err := sha256File(finalPath); err == nil {
+		if err := dedupCheck(url, finalPath, sum); err != nil {
+			fmt.Printf("去重检查失败: %s - %v\n", finalPath, err)
+		}
+	}
+	return nil
+}
+
+// countingWriter 只统计写入的字节数，不保存内容，配合 io.TeeReader 统计实际通过存储后端传输的字节数
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// sha256File 完整读一遍已落盘的文件，算出内容哈希，用于分片下载完成后的去重检查
+func sha256File(filePath string) ([]byte, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// downloadSingleStream 是不支持 Range 或文件太小时的单流下载：先嗅探响应体的前一段内容做校验，
+// 再把嗅探过的内容和剩余响应体拼接起来流式拷贝到磁盘，不整体读入内存
+func downloadSingleStream(url, stem string) error {
+	resp, err := doWithRetry(url, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, url, nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("下载请求返回非 200 状态码: %d", resp.StatusCode)
+	}
+
+	head, err := readHead(resp.Body)
+	if err != nil {
+		return err
+	}
+	result := inspectImage(head, resp.Header.Get("Content-Type"), resp.ContentLength)
+	combined := io.MultiReader(bytes.NewReader(head), resp.Body)
+
+	var fullPath string
+	if result.accepted {
+		fullPath = path.Join(config.StoragePath, stem+result.ext)
+	} else {
+		fullPath = rejectedPath(stem, result.reason)
+	}
+	if err := os.MkdirAll(path.Dir(fullPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	out, err := os.Create(fullPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// 顺手用 TeeReader 算出内容哈希，下载完成后直接喂给去重索引，不用再读一遍文件
+	hasher := sha256.New()
+	n, err := io.Copy(out, io.TeeReader(combined, hasher))
+	if err != nil {
+		return err
+	}
+	if result.accepted {
+		recordSuccess(url, n)
+		markDownloaded(stem, stem+result.ext)
+		if err := dedupCheck(url, fullPath, hasher.Sum(nil)); err != nil {
+			fmt.Printf("去重检查失败: %s - %v\n", fullPath, err)
+		}
+	} else {
+		recordOutcome(result.reason, 0)
+	}
+	return nil
+}
+
+// downloadToBackend 先嗅探响应体的前一段内容做校验，再把嗅探过的内容和剩余响应体拼接起来流式写入存储后端
+func downloadToBackend(url, stem string) error {
+	resp, err := doWithRetry(url, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, url, nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("下载请求返回非 200 状态码: %d", resp.StatusCode)
+	}
+
+	head, err := readHead(resp.Body)
+	if err != nil {
+		return err
+	}
+	result := inspectImage(head, resp.Header.Get("Content-Type"), resp.ContentLength)
+	combined := io.MultiReader(bytes.NewReader(head), resp.Body)
+
+	meta := map[string]string{"url": url}
+	var key string
+	if result.accepted {
+		key = stem + result.ext
+	} else {
+		key = "rejected/" + stem + "." + result.reason
+		meta["reason"] = result.reason
+	}
+
+	// 顺手用 TeeReader 算出内容哈希，上传完成后直接喂给去重索引，不用再读一遍对象；
+	// 同时统计实际写入的字节数——resp.ContentLength 在分块传输编码下是 -1，直接喂给
+	// Prometheus 计数器的 Add 会因为负增量 panic，必须用实际拷贝的字节数
+	hasher := sha256.New()
+	counter := &countingWriter{}
+	if err := backend.Put(context.Background(), key, io.TeeReader(combined, io.MultiWriter(hasher, counter)), resp.ContentLength, meta); err != nil {
+		return err
+	}
+	if result.accepted {
+		recordSuccess(url, counter.n)
+		markDownloaded(stem, key)
+		if err := dedupCheckRemote(url, key, hasher.Sum(nil)); err != nil {
+			fmt.Printf("去重检查失败: %s - %v\n", key, err)
+		}
+	} else {
+		recordOutcome(result.reason, 0)
+	}
+	return nil
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/viper"
-	"io"
+	"github.com/t8y2/datacomp-crawl/dedup"
+	"github.com/t8y2/datacomp-crawl/storage"
 	"log"
 	"net/http"
 	"net/url"
@@ -16,15 +19,34 @@ import (
 	"time"
 )
 
+// dedupPHashHamming 是 --dedup-phash-hamming=N 命令行开关，覆盖配置文件里的同名项，
+// 0 表示只做 sha256 精确去重，不做感知哈希近似去重
+var dedupPHashHamming = flag.Int("dedup-phash-hamming", 0, "按感知哈希近似去重时允许的最大汉明距离，0 表示关闭近似去重")
+
 type Config struct {
-	Timeout       int    `yaml:"timeout" mapstructure:"timeout"`
-	MaxConcurrent int    `yaml:"max_concurrent" mapstructure:"max_concurrent"`
-	ProxyURL      string `yaml:"proxy_url" mapstructure:"proxy_url"`
-	UrlsPath      string `yaml:"urls_path" mapstructure:"urls_path"`
-	FailPath      string `yaml:"fail_path" mapstructure:"fail_path"`
-	StoragePath   string `yaml:"storage_path" mapstructure:"storage_path"`
-	LogPath       string `yaml:"log_path" mapstructure:"log_path"`
-	UseProxy      bool   `yaml:"use_proxy" mapstructure:"use_proxy"`
+	Timeout             int            `yaml:"timeout" mapstructure:"timeout"`
+	MaxConcurrent       int            `yaml:"max_concurrent" mapstructure:"max_concurrent"`
+	ProxyURL            string         `yaml:"proxy_url" mapstructure:"proxy_url"`
+	UrlsPath            string         `yaml:"urls_path" mapstructure:"urls_path"`
+	FailPath            string         `yaml:"fail_path" mapstructure:"fail_path"`
+	StoragePath         string         `yaml:"storage_path" mapstructure:"storage_path"`
+	LogPath             string         `yaml:"log_path" mapstructure:"log_path"`
+	UseProxy            bool           `yaml:"use_proxy" mapstructure:"use_proxy"`
+	ConnectionsPerFile  int            `yaml:"connections_per_file" mapstructure:"connections_per_file"`
+	MinSizeForMultipart int64          `yaml:"min_size_for_multipart" mapstructure:"min_size_for_multipart"`
+	MaxRetries          int            `yaml:"max_retries" mapstructure:"max_retries"`
+	InitialBackoffMs    int            `yaml:"initial_backoff_ms" mapstructure:"initial_backoff_ms"`
+	MaxBackoffMs        int            `yaml:"max_backoff_ms" mapstructure:"max_backoff_ms"`
+	PerHostRPS          float64        `yaml:"per_host_rps" mapstructure:"per_host_rps"`
+	PerHostBurst        int            `yaml:"per_host_burst" mapstructure:"per_host_burst"`
+	Storage             storage.Config `yaml:"storage" mapstructure:"storage"`
+	ShardedOutput       bool           `yaml:"sharded_output" mapstructure:"sharded_output"`
+	MinWidth            int            `yaml:"min_width" mapstructure:"min_width"`
+	MinHeight           int            `yaml:"min_height" mapstructure:"min_height"`
+	MaxFileSize         int64          `yaml:"max_file_size" mapstructure:"max_file_size"`
+	RejectedPath        string         `yaml:"rejected_path" mapstructure:"rejected_path"`
+	MetricsPort         int            `yaml:"metrics_port" mapstructure:"metrics_port"`
+	Dedup               DedupConfig    `yaml:"dedup" mapstructure:"dedup"`
 }
 
 func getConfig() {
@@ -47,6 +69,7 @@ var (
 	httpClient       *http.Client
 	failRecords      []string // 存储失败记录
 	lastRoundEndTime time.Time
+	backend          storage.Backend // 图片落地的存储后端，默认本地磁盘
 )
 
 type CustomTransport struct {
@@ -105,6 +128,23 @@ func init() {
 
 	// 初始化信号量
 	sem = make(chan struct{}, config.MaxConcurrent)
+
+	// 分片打包模式下每个分片单独开一个 tar 后端，这里不需要全局后端
+	if config.Storage.LocalRoot == "" {
+		config.Storage.LocalRoot = config.StoragePath
+	}
+	if !config.ShardedOutput {
+		backend, err = storage.New(config.Storage)
+		if err != nil {
+			fmt.Printf("初始化存储后端失败: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// 启动内嵌的 /metrics 和 /status 服务，端口为 0 时不启动
+	startMetricsServer(config.MetricsPort)
+
+	openDedupStore()
 }
 
 func createDirAndFailFile(filename string) {
@@ -121,61 +161,76 @@ func createDirAndFailFile(filename string) {
 		fmt.Printf("无法创建日志文件存储目录: %s - %v\n", config.LogPath, err)
 		os.Exit(1)
 	}
+	if err := os.MkdirAll(config.RejectedPath, os.ModePerm); err != nil {
+		fmt.Printf("无法创建拒绝图片存储目录: %s - %v\n", config.RejectedPath, err)
+		os.Exit(1)
+	}
 }
 
-func sanitizePath(path string) string {
-	// 将路径转换为小写以支持大小写敏感
-	lowerPath := strings.ToLower(path)
-	// 检查特定文件扩展名并删除其后面的内容
-	exts := []string{".jpg", ".jpeg", ".png", ".webp"}
-	for _, ext := range exts {
-		if idx := strings.Index(lowerPath, ext); idx != -1 {
-			return path[:idx+len(ext)] // 只保留扩展名
-		}
+// stripExt 去掉路径的扩展名，真正落盘用的扩展名改由内容嗅探结果决定，而不是 URL/文件名里写的那个
+func stripExt(p string) string {
+	if idx := strings.LastIndex(p, "."); idx != -1 {
+		return p[:idx]
 	}
-	return "not-pic"
+	return p
 }
 
 func downloadImage(url, filepath string) {
-	resp, err := httpClient.Get(url) // 使用全局的httpClient.Get(url)
-	if err != nil {
-		writeFailedRecord(url, filepath)
-		//fmt.Printf("下载失败:%v\n", err)
+	stem := stripExt(filepath)
+
+	// 重跑同一分片时，已经完整落盘/上传过的对象直接跳过，真正实现"中断后恢复"——
+	// 之前分片续传只覆盖了多连接下载中途的分片进度，完整下载完的对象再跑一次还是会被整个重新拉取
+	if alreadyDownloaded(stem) {
+		advanceShardProgress()
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		if resp.StatusCode == 403 || resp.StatusCode == 429 {
-			writeFailedRecord(url, filepath)
-			return
+	inFlightGauge.Inc()
+	timer := prometheus.NewTimer(latencySeconds)
+	defer func() {
+		timer.ObserveDuration()
+		inFlightGauge.Dec()
+		advanceShardProgress()
+	}()
+
+	// 分片续传依赖本地文件的随机写入，只有本地磁盘且非打包模式下才启用
+	if storage.IsLocal(config.Storage) && !config.ShardedOutput {
+		connections := config.ConnectionsPerFile
+		if connections < 1 {
+			connections = 1
 		}
-	}
-	// 先将响应体全部读入内存
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		writeFailedRecord(url, filepath)
-		//fmt.Printf("读取响应体失败: %s - %v\n", url, err)
-		return
-	}
-	// 检查路径是否合法
-	if sanitizedPath := sanitizePath(filepath); sanitizedPath != "not-pic" {
-		fileStoragePath := path.Join(config.StoragePath, sanitizedPath)
-		// 创建文件并将数据写入文件
-		out, err := os.Create(fileStoragePath)
-		if err != nil {
-			writeFailedRecord(url, filepath)
-			fmt.Printf("创建文件失败: %s - %v\n", sanitizedPath, err)
-			return
+
+		// connections_per_file <= 1 时肯定走单流下载，没必要先发一个 Range 探测请求把请求数翻倍——
+		// 单流下载本来就是从真实 GET 的响应头里拿 size/Content-Type，不需要单独探测
+		if connections > 1 {
+			// 先探测目标是否支持 Range，拿到文件大小和声明的 Content-Type
+			size, supportsRange, contentType, err := probeRange(url)
+			if err != nil {
+				recordFailure(url, filepath, err)
+				return
+			}
+
+			if supportsRange && size >= config.MinSizeForMultipart {
+				if err := downloadMultipart(url, stem, size, contentType); err != nil {
+					recordFailure(url, filepath, err)
+					//fmt.Printf("分片下载失败: %s - %v\n", stem, err)
+				}
+				return
+			}
 		}
-		defer out.Close()
 
-		if _, err := out.Write(body); err != nil {
-			writeFailedRecord(url, filepath)
-			//fmt.Printf("写入文件失败: %s - %v\n", sanitizedPath, err)
-		} else {
-			//fmt.Printf("下载完成: %s\n", sanitizedPath)
+		// 不支持 Range、文件太小或本来就配置成单连接，退化为单流下载
+		if err := downloadSingleStream(url, stem); err != nil {
+			recordFailure(url, filepath, err)
+			//fmt.Printf("下载失败: %s - %v\n", stem, err)
 		}
+		return
+	}
+
+	// S3/OSS 或打包模式下，直接把响应体流式写入存储后端
+	if err := downloadToBackend(url, stem); err != nil {
+		recordFailure(url, filepath, err)
+		//fmt.Printf("下载失败: %s - %v\n", stem, err)
 	}
 }
 
@@ -201,6 +256,40 @@ func writeFailedRecordsToFile(filename string) {
 
 func downloadImagesFromFile(filename string) {
 	fmt.Printf("开始下载%v\n", filename)
+
+	// 开启去重时，每个分片单独生成一份 manifest.jsonl 记录该分片内的去重决策
+	if config.Dedup.Enabled {
+		manifestPath := path.Join(config.StoragePath, filename+".manifest.jsonl")
+		manifest, err := dedup.OpenManifest(manifestPath)
+		if err != nil {
+			fmt.Printf("创建去重 manifest 失败: %s - %v\n", manifestPath, err)
+			return
+		}
+		dedupManifest = manifest
+		defer func() {
+			if err := dedupManifest.Close(); err != nil {
+				fmt.Printf("关闭去重 manifest 失败: %s - %v\n", manifestPath, err)
+			}
+			dedupManifest = nil
+		}()
+	}
+
+	// 打包模式下每个分片单独生成一个 webdataset 风格的 tar 包
+	if config.ShardedOutput {
+		tarPath := path.Join(config.StoragePath, filename+".tar")
+		shardBackend, err := storage.NewShardBackend(tarPath)
+		if err != nil {
+			fmt.Printf("创建分片打包文件失败: %s - %v\n", tarPath, err)
+			return
+		}
+		backend = shardBackend
+		defer func() {
+			if err := shardBackend.Close(); err != nil {
+				fmt.Printf("关闭分片打包文件失败: %s - %v\n", tarPath, err)
+			}
+		}()
+	}
+
 	// 打开文件
 	bT := time.Now()
 	urlFilePath := path.Join(config.UrlsPath, filename+".txt")
@@ -219,6 +308,8 @@ func downloadImagesFromFile(filename string) {
 	eT := time.Since(bT) // 从开始到当前所消耗的时间
 	fmt.Println("所有行读取完成，耗时: ", eT, "总行数: ", len(lines))
 
+	startShardProgress(filename, len(lines))
+
 	// 开始处理每一行
 	for _, line := range lines {
 		parts := strings.SplitN(line, " ", 2)
@@ -285,6 +376,14 @@ func writeLog(startNum, endNum int, filename string) {
 	fmt.Printf("%s: 日志写入完成\n", filename)
 }
 func main() {
+	flag.Parse()
+	// 只有用户显式传了 --dedup-phash-hamming 才覆盖配置文件里的值，
+	// 否则命令行的默认值 0 会把 crawl.yaml 里的 dedup.phash_hamming_distance 永远盖掉
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "dedup-phash-hamming" {
+			config.Dedup.PHashHammingDistance = *dedupPHashHamming
+		}
+	})
 
 	startNum, endNum := getStartAndEndIndex()
 	for i := startNum; i <= endNum; i++ {
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"container/ring"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	downloadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "crawl_downloads_total",
+		Help: "按结果状态统计的下载数量，status 取值如 ok/403/429/timeout/decode_fail",
+	}, []string{"status"})
+
+	bytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "crawl_bytes_total",
+		Help: "成功下载的累计字节数",
+	})
+
+	latencySeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "crawl_latency_seconds",
+		Help:    "单张图片从开始下载到结束的耗时分布",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	inFlightGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "crawl_in_flight",
+		Help: "当前正在进行的下载数",
+	})
+
+	shardProgressGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "crawl_shard_progress",
+		Help: "当前分片已处理行数占总行数的比例（0-1）",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(downloadsTotal, bytesTotal, latencySeconds, inFlightGauge, shardProgressGauge)
+}
+
+// classifyFailure 把下载过程中的 error 归类成 Prometheus 状态标签，用字符串匹配而非结构化错误类型，
+// 胜在简单，足以覆盖目前这几类失败原因
+func classifyFailure(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "429"):
+		return "429"
+	case strings.Contains(msg, "403"):
+		return "403"
+	case strings.Contains(msg, "timeout") || strings.Contains(msg, "deadline exceeded"):
+		return "timeout"
+	case strings.Contains(msg, "状态码: 5") || strings.Contains(msg, "状态码: 50"):
+		return "5xx"
+	default:
+		return "other"
+	}
+}
+
+// recordOutcome 记录一次下载的最终结果：成功记字节数和耗时，被拒绝或失败记对应的原因标签
+func recordOutcome(status string, bytes int64) {
+	downloadsTotal.WithLabelValues(status).Inc()
+	if status == "ok" {
+		bytesTotal.Add(float64(bytes))
+	}
+}
+
+// failureSample 是一条最近失败记录的快照，供 /status 接口展示
+type failureSample struct {
+	URL    string    `json:"url"`
+	Path   string    `json:"path"`
+	Status string    `json:"status"`
+	Time   time.Time `json:"time"`
+}
+
+// hostErrorCounter 统计某个主机的请求总数和失败数，用于 /status 里的 per-host 错误率
+type hostErrorCounter struct {
+	attempts int64
+	errors   int64
+}
+
+var (
+	recentFailuresMu sync.Mutex
+	recentFailures   = ring.New(50)
+
+	hostErrorsMu sync.Mutex
+	hostErrors   = map[string]*hostErrorCounter{}
+
+	crawlStatusMu   sync.Mutex
+	currentShard    string
+	shardStartedAt  time.Time
+	shardTotalLines int64
+	shardDoneLines  int64 // 用 atomic 操作，避免在下载热路径上加锁
+)
+
+// recordFailure 把失败写入原有的失败列表文件，同时喂给 Prometheus 计数器和 /status 的最近失败样本
+func recordFailure(url, path string, err error) {
+	writeFailedRecord(url, path)
+
+	status := classifyFailure(err)
+	recordOutcome(status, 0)
+
+	host := hostOf(url)
+	hostErrorsMu.Lock()
+	c, ok := hostErrors[host]
+	if !ok {
+		c = &hostErrorCounter{}
+		hostErrors[host] = c
+	}
+	c.attempts++
+	c.errors++
+	hostErrorsMu.Unlock()
+
+	recentFailuresMu.Lock()
+	recentFailures.Value = failureSample{URL: url, Path: path, Status: status, Time: time.Now()}
+	recentFailures = recentFailures.Next()
+	recentFailuresMu.Unlock()
+}
+
+// recordSuccess 记一次成功下载的字节数，并把该主机的请求计数加一
+func recordSuccess(url string, bytes int64) {
+	recordOutcome("ok", bytes)
+
+	host := hostOf(url)
+	hostErrorsMu.Lock()
+	c, ok := hostErrors[host]
+	if !ok {
+		c = &hostErrorCounter{}
+		hostErrors[host] = c
+	}
+	c.attempts++
+	hostErrorsMu.Unlock()
+}
+
+// startShardProgress 在开始处理一个分片时重置进度计数，totalLines 为该分片的 URL 总行数
+func startShardProgress(filename string, totalLines int) {
+	crawlStatusMu.Lock()
+	currentShard = filename
+	shardStartedAt = time.Now()
+	crawlStatusMu.Unlock()
+
+	atomic.StoreInt64(&shardTotalLines, int64(totalLines))
+	atomic.StoreInt64(&shardDoneLines, 0)
+	shardProgressGauge.Set(0)
+}
+
+// advanceShardProgress 在每处理完一行后调用，只做原子自增，不持锁
+func advanceShardProgress() {
+	done := atomic.AddInt64(&shardDoneLines, 1)
+	total := atomic.LoadInt64(&shardTotalLines)
+	if total > 0 {
+		shardProgressGauge.Set(float64(done) / float64(total))
+	}
+}
+
+// statusResponse 是 /status 接口返回的 JSON 结构
+type statusResponse struct {
+	CurrentShard     string             `json:"current_shard"`
+	CompletionRatio  float64            `json:"completion_ratio"`
+	ETASeconds       float64            `json:"eta_seconds"`
+	PerHostErrorRate map[string]float64 `json:"per_host_error_rate"`
+	RecentFailures   []failureSample    `json:"recent_failures"`
+}
+
+func buildStatusResponse() statusResponse {
+	crawlStatusMu.Lock()
+	shard := currentShard
+	startedAt := shardStartedAt
+	crawlStatusMu.Unlock()
+
+	done := atomic.LoadInt64(&shardDoneLines)
+	total := atomic.LoadInt64(&shardTotalLines)
+
+	var ratio, etaSeconds float64
+	if total > 0 {
+		ratio = float64(done) / float64(total)
+		if done > 0 {
+			elapsed := time.Since(startedAt).Seconds()
+			perLine := elapsed / float64(done)
+			etaSeconds = perLine * float64(total-done)
+		}
+	}
+
+	hostErrorsMu.Lock()
+	errorRates := make(map[string]float64, len(hostErrors))
+	for host, c := range hostErrors {
+		if c.attempts > 0 {
+			errorRates[host] = float64(c.errors) / float64(c.attempts)
+		}
+	}
+	hostErrorsMu.Unlock()
+
+	recentFailuresMu.Lock()
+	var samples []failureSample
+	recentFailures.Do(func(v interface{}) {
+		if v == nil {
+			return
+		}
+		samples = append(samples, v.(failureSample))
+	})
+	recentFailuresMu.Unlock()
+
+	return statusResponse{
+		CurrentShard:     shard,
+		CompletionRatio:  ratio,
+		ETASeconds:       etaSeconds,
+		PerHostErrorRate: errorRates,
+		RecentFailures:   samples,
+	}
+}
+
+// startMetricsServer 启动一个内嵌的 HTTP 服务，暴露 Prometheus /metrics 和 JSON /status，
+// 端口由 Config.MetricsPort 指定，为 0 则不启动
+func startMetricsServer(port int) {
+	if port <= 0 {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(buildStatusResponse())
+	})
+	go func() {
+		addr := fmt.Sprintf(":%d", port)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fmt.Printf("指标服务启动失败: %v\n", err)
+		}
+	}()
+}
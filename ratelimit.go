@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// minHostRate 是单个主机限速被惩罚后允许降到的下限，避免完全卡死
+const minHostRate = 0.1
+
+// hostState 记录某个主机当前的限速器以及是否处于 429/403 冷却期
+type hostState struct {
+	mu            sync.Mutex
+	limiter       *rate.Limiter
+	baseLimit     rate.Limit
+	cooldownUntil time.Time
+}
+
+var (
+	hostStatesMu sync.Mutex
+	hostStates   = map[string]*hostState{}
+)
+
+// hostOf 从 URL 中取出主机名，解析失败时原样返回，作为限速器的 key
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Host
+}
+
+// getHostState 按需创建某个主机的限速状态，初始速率来自配置的 per_host_rps/per_host_burst。
+// per_host_rps <= 0（未配置，或沿用了引入这个配置项之前的 crawl.yaml）视为不限速——
+// rate.NewLimiter(0, burst) 初始突发用完后永远不再放行，会让该主机后续所有请求在 waitForHost
+// 里死等，且不报错不退出，比配置错误更难排查。
+func getHostState(host string) *hostState {
+	hostStatesMu.Lock()
+	defer hostStatesMu.Unlock()
+	if s, ok := hostStates[host]; ok {
+		return s
+	}
+	base := rate.Limit(config.PerHostRPS)
+	if config.PerHostRPS <= 0 {
+		base = rate.Inf
+	}
+	burst := config.PerHostBurst
+	if burst < 1 {
+		burst = 1
+	}
+	s := &hostState{
+		limiter:   rate.NewLimiter(base, burst),
+		baseLimit: base,
+	}
+	hostStates[host] = s
+	return s
+}
+
+// waitForHost 在发起请求前按该主机的限速器排队，实现每主机限流
+func waitForHost(host string) {
+	getHostState(host).limiter.Wait(context.Background())
+}
+
+// penalizeHost 在收到 429/403 后把该主机的限速减半，并进入冷却期（AIMD 的乘性降低）。
+// per_host_rps 未配置时基准是 rate.Inf（math.MaxFloat64），对它连续减半在合理的 429 次数内
+// 几乎不会降到 minHostRate 以下，等于没有惩罚，所以从 Inf 起罚时改成给一个具体的起始速率。
+func penalizeHost(host string, cooldown time.Duration) {
+	s := getHostState(host)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := s.limiter.Limit()
+	newLimit := current / 2
+	if current >= rate.Inf {
+		newLimit = 1
+	}
+	if newLimit < minHostRate {
+		newLimit = minHostRate
+	}
+	s.limiter.SetLimit(newLimit)
+	s.cooldownUntil = time.Now().Add(cooldown)
+}
+
+// rampUpHost 在冷却期结束后逐步把限速加回基准值（AIMD 的加性恢复）
+func rampUpHost(host string) {
+	s := getHostState(host)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Now().Before(s.cooldownUntil) {
+		return
+	}
+	current := s.limiter.Limit()
+	if current >= s.baseLimit {
+		return
+	}
+	next := current + rate.Limit(0.5)
+	if next > s.baseLimit {
+		next = s.baseLimit
+	}
+	s.limiter.SetLimit(next)
+}
+
+// parseRetryAfter 解析 Retry-After 响应头（秒数形式），解析失败或为空返回 0
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	seconds, err := strconv.Atoi(header)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// jitter 给退避时间加上 0~50% 的随机抖动，避免重试风暴
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d) / 2))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// cooldownWindow 是某主机被限速/封禁后的冷却时长，冷却期内维持降速状态
+const cooldownWindow = 30 * time.Second
+
+// isRetryableStatus 判断状态码是否值得重试：429/403 走限流退避，5xx 走普通退避
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode == http.StatusForbidden || statusCode >= 500
+}
+
+// doWithRetry 对单次 HTTP 请求执行"每主机限速 + 指数退避重试"，并在 429/403 时触发该主机的降速冷却
+func doWithRetry(url string, newReq func() (*http.Request, error)) (*http.Response, error) {
+	host := hostOf(url)
+	backoff := time.Duration(config.InitialBackoffMs) * time.Millisecond
+	maxBackoff := time.Duration(config.MaxBackoffMs) * time.Millisecond
+
+	var lastErr error
+	for attempt := 0; attempt <= config.MaxRetries; attempt++ {
+		rampUpHost(host)
+		waitForHost(host)
+
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			lastErr = err
+		} else if isRetryableStatus(resp.StatusCode) {
+			lastErr = fmt.Errorf("请求返回状态码: %d", resp.StatusCode)
+			if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusForbidden {
+				retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+				penalizeHost(host, cooldownWindow)
+				resp.Body.Close()
+				if retryAfter > 0 {
+					time.Sleep(retryAfter)
+					continue
+				}
+			} else {
+				resp.Body.Close()
+			}
+		} else {
+			return resp, nil
+		}
+
+		if attempt == config.MaxRetries {
+			break
+		}
+		time.Sleep(backoff + jitter(backoff))
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+	return nil, lastErr
+}
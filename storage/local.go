@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// LocalBackend 把对象直接流式写入本地磁盘目录，是默认的存储后端
+type LocalBackend struct {
+	Root string
+}
+
+// NewLocalBackend 创建一个以 root 为根目录的本地磁盘后端
+func NewLocalBackend(root string) *LocalBackend {
+	return &LocalBackend{Root: root}
+}
+
+func (b *LocalBackend) fullPath(key string) string {
+	return filepath.Join(b.Root, key)
+}
+
+// Put 把 r 直接流式拷贝到目标文件，不在内存中缓存整个对象
+func (b *LocalBackend) Put(ctx context.Context, key string, r io.Reader, size int64, meta map[string]string) error {
+	fullPath := b.fullPath(key)
+	if err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm); err != nil {
+		return err
+	}
+	out, err := os.Create(fullPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, r)
+	return err
+}
+
+// Exists 判断目标文件是否已经存在于本地磁盘
+func (b *LocalBackend) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := os.Stat(b.fullPath(key))
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"context"
+	"io"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// OSSBackend 把对象写入阿里云 OSS
+type OSSBackend struct {
+	bucket *oss.Bucket
+}
+
+// NewOSSBackend 根据配置里的 endpoint/ak-sk/bucket 创建一个 OSS 客户端
+func NewOSSBackend(cfg Config) (*OSSBackend, error) {
+	client, err := oss.New(cfg.Endpoint, cfg.AccessKeyID, cfg.AccessKeySecret)
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := client.Bucket(cfg.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	return &OSSBackend{bucket: bucket}, nil
+}
+
+// Put 把响应体流式上传到 OSS 对象，metadata 作为对象的用户自定义元数据
+func (b *OSSBackend) Put(ctx context.Context, key string, r io.Reader, size int64, meta map[string]string) error {
+	var options []oss.Option
+	for k, v := range meta {
+		options = append(options, oss.Meta(k, v))
+	}
+	return b.bucket.PutObject(key, r, options...)
+}
+
+// Exists 判断对象是否已经存在于 OSS bucket 中
+func (b *OSSBackend) Exists(ctx context.Context, key string) (bool, error) {
+	return b.bucket.IsObjectExist(key)
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// S3Backend 把对象写入 AWS S3（或兼容 S3 协议的对象存储）
+type S3Backend struct {
+	client *s3.Client
+	bucket string
+}
+
+// NewS3Backend 根据配置里的 region/endpoint/ak-sk 创建一个 S3 客户端
+func NewS3Backend(cfg Config) (*S3Backend, error) {
+	opts := []func(*awsconfig.LoadOptions) error{
+		awsconfig.WithRegion(cfg.Region),
+	}
+	if cfg.AccessKeyID != "" {
+		opts = append(opts, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(cfg.AccessKeyID, cfg.AccessKeySecret, ""),
+		))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+	})
+	return &S3Backend{client: client, bucket: cfg.Bucket}, nil
+}
+
+// Put 把响应体流式上传到 S3 对象，metadata 作为对象的用户自定义元数据
+func (b *S3Backend) Put(ctx context.Context, key string, r io.Reader, size int64, meta map[string]string) error {
+	_, err := b.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:   aws.String(b.bucket),
+		Key:      aws.String(key),
+		Body:     r,
+		Metadata: meta,
+	})
+	return err
+}
+
+// Exists 通过 HeadObject 判断对象是否已经存在
+func (b *S3Backend) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := b.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	if err == nil {
+		return true, nil
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NotFound" {
+		return false, nil
+	}
+	return false, err
+}
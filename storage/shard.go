@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// ShardBackend 把一个分片内的所有对象打包进一个 webdataset 风格的 .tar 文件
+type ShardBackend struct {
+	mu   sync.Mutex
+	file *os.File
+	tw   *tar.Writer
+	keys map[string]bool
+}
+
+// NewShardBackend 在 tarPath 打开（或创建）一个分片 tar 包。如果 tarPath 已经存在（上一次运行的
+// tar，例如程序在多日、3550 分片的爬取中途被打断），先重放已有 entry 重建 keys 索引，再把写入游标
+// 定位到最后一个完整 entry 之后继续追加，而不是用 os.Create 直接截断丢弃已经付过下载带宽的内容。
+func NewShardBackend(tarPath string) (*ShardBackend, error) {
+	file, err := os.OpenFile(tarPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]bool)
+	offset, err := rebuildShardIndex(file, keys)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &ShardBackend{
+		file: file,
+		tw:   tar.NewWriter(file),
+		keys: keys,
+	}, nil
+}
+
+// tarBlockSize 是 tar 格式的块对齐大小：每个 entry 由一个头块加上内容按块对齐填充后的数据组成
+const tarBlockSize = 512
+
+// rebuildShardIndex 顺序读出 tar 里已有的 entry 记入 keys，返回最后一个完整 entry 结束的字节偏移
+// （即末尾两个全零结束块之前的位置）。新建的空文件直接返回 0；如果上次运行在写某个 entry 中途被打断
+// 留下了截断的尾部数据，那段无法解析的尾部会被丢弃，只保留已经完整落盘的 entry。
+// 偏移量按头部信息里的 Size 字段自己累加，而不是读完每个 entry 后用 Seek 查询当前位置——
+// tar.Reader 在底层 io.Reader 支持 Seek 时会惰性跳过 entry 内容，只有读下一个头之前才真正 Seek，
+// 所以 Next() 刚返回时的文件位置只到本条头块末尾，还没跳过它的内容，不能当作 entry 结束位置用。
+func rebuildShardIndex(file *os.File, keys map[string]bool) (int64, error) {
+	tr := tar.NewReader(file)
+	var offset int64
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		keys[hdr.Name] = true
+		contentBlocks := (hdr.Size + tarBlockSize - 1) / tarBlockSize
+		offset += tarBlockSize + contentBlocks*tarBlockSize
+	}
+	return offset, nil
+}
+
+// Put 把对象作为一个 tar entry 写入分片包，entry 名即 key。
+// tar 格式要求写 header 前就知道条目大小，size 未知（如分块传输）时才退化为先读入内存。
+func (b *ShardBackend) Put(ctx context.Context, key string, r io.Reader, size int64, meta map[string]string) error {
+	if size <= 0 {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		size = int64(len(data))
+		r = bytes.NewReader(data)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	hdr := &tar.Header{
+		Name:    key,
+		Size:    size,
+		Mode:    0644,
+		ModTime: time.Now(),
+	}
+	if err := b.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := io.Copy(b.tw, r); err != nil {
+		return err
+	}
+	b.keys[key] = true
+	return nil
+}
+
+// Exists 判断 key 是否已经在 keys 索引里，覆盖本次运行写入的 entry 和 NewShardBackend 从已有
+// tar 重建索引时读到的 entry；tar 格式不支持随机查找，所以索引只能靠启动时整份重放得到
+func (b *ShardBackend) Exists(ctx context.Context, key string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.keys[key], nil
+}
+
+// Close 把 tar 包的尾部写完并关闭底层文件，每个分片处理完后必须调用
+func (b *ShardBackend) Close() error {
+	if err := b.tw.Close(); err != nil {
+		b.file.Close()
+		return err
+	}
+	return b.file.Close()
+}
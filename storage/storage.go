@@ -0,0 +1,44 @@
+// Package storage 抽象了图片落地的目的地，支持本地磁盘、S3、阿里云 OSS 等后端
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// Backend 是存储后端的统一接口，local/s3/oss 等具体实现都满足它
+type Backend interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, meta map[string]string) error
+	Exists(ctx context.Context, key string) (bool, error)
+}
+
+// Config 对应 crawl.yaml 里的 storage: 配置块
+type Config struct {
+	Backend         string `yaml:"backend" mapstructure:"backend"`
+	LocalRoot       string `yaml:"local_root" mapstructure:"local_root"`
+	Bucket          string `yaml:"bucket" mapstructure:"bucket"`
+	Region          string `yaml:"region" mapstructure:"region"`
+	Endpoint        string `yaml:"endpoint" mapstructure:"endpoint"`
+	AccessKeyID     string `yaml:"access_key_id" mapstructure:"access_key_id"`
+	AccessKeySecret string `yaml:"access_key_secret" mapstructure:"access_key_secret"`
+}
+
+// New 根据 Config.Backend 选择并初始化具体的存储后端
+func New(cfg Config) (Backend, error) {
+	switch cfg.Backend {
+	case "", "local":
+		return NewLocalBackend(cfg.LocalRoot), nil
+	case "s3":
+		return NewS3Backend(cfg)
+	case "oss":
+		return NewOSSBackend(cfg)
+	default:
+		return nil, fmt.Errorf("未知的存储后端: %s", cfg.Backend)
+	}
+}
+
+// IsLocal 判断当前后端是否为本地磁盘，分片续传依赖本地随机写入，只能在这种后端下启用
+func IsLocal(cfg Config) bool {
+	return cfg.Backend == "" || cfg.Backend == "local"
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	_ "golang.org/x/image/webp"
+)
+
+// sniffHeadSize 覆盖绝大多数图片格式的文件头和尺寸信息，同时避免对大图完整缓冲进内存
+const sniffHeadSize = 256 * 1024
+
+// extByContentType 把嗅探到的 Content-Type 映射到落盘用的扩展名
+var extByContentType = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+	"image/gif":  ".gif",
+	"image/avif": ".avif",
+	"image/heic": ".heic",
+}
+
+// sniffContentType 在 http.DetectContentType 的基础上，补充识别它无法识别的 AVIF/HEIC 魔数（基于 ISOBMFF ftyp box）
+func sniffContentType(head []byte) string {
+	if ct := http.DetectContentType(head); ct != "application/octet-stream" {
+		return ct
+	}
+	if len(head) >= 12 && string(head[4:8]) == "ftyp" {
+		switch string(head[8:12]) {
+		case "avif", "avis":
+			return "image/avif"
+		case "heic", "heix", "heim", "heis", "mif1":
+			return "image/heic"
+		}
+	}
+	return "application/octet-stream"
+}
+
+// inspectionResult 是内容嗅探、Content-Type 交叉校验、解码校验和最小尺寸校验后的判定结果
+type inspectionResult struct {
+	accepted bool
+	reason   string // 被拒绝时的原因标签，用于 rejected/ 目录分类，如 html、too_small、decode_fail
+	ext      string
+	width    int
+	height   int
+}
+
+// inspectImage 读取响应体的前若干字节做真实内容检测，替代原来只按 URL 后缀猜测文件类型的做法
+func inspectImage(head []byte, declaredContentType string, totalSize int64) inspectionResult {
+	if totalSize == 0 || len(head) == 0 {
+		return inspectionResult{reason: "empty"}
+	}
+	if config.MaxFileSize > 0 && totalSize > config.MaxFileSize {
+		return inspectionResult{reason: "too_large"}
+	}
+
+	sniffed := sniffContentType(head)
+	ext, known := extByContentType[sniffed]
+	if !known {
+		// 典型场景：CDN 返回了 200 OK 的 HTML 拦截页，却被当成图片保存
+		return inspectionResult{reason: "not_image"}
+	}
+	if declaredContentType != "" &&
+		!strings.HasPrefix(declaredContentType, "image/") &&
+		!strings.Contains(declaredContentType, "octet-stream") {
+		return inspectionResult{reason: "content_type_mismatch"}
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(head))
+	if err != nil {
+		// AVIF/HEIC 没有注册的标准库解码器，跳过尺寸解码，仅信任魔数嗅探结果
+		if sniffed == "image/avif" || sniffed == "image/heic" {
+			return inspectionResult{accepted: true, ext: ext}
+		}
+		return inspectionResult{reason: "decode_fail"}
+	}
+	if cfg.Width < config.MinWidth || cfg.Height < config.MinHeight {
+		return inspectionResult{reason: "too_small", width: cfg.Width, height: cfg.Height}
+	}
+
+	return inspectionResult{accepted: true, ext: ext, width: cfg.Width, height: cfg.Height}
+}
+
+// readHead 读取 r 的前 sniffHeadSize 字节用于嗅探和解码校验，返回实际读到的内容（文件可能小于 sniffHeadSize）
+func readHead(r io.Reader) ([]byte, error) {
+	buf := make([]byte, sniffHeadSize)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// rejectedPath 返回某个相对路径在 rejected/ 目录下的归档路径，文件名里带上拒绝原因，方便审计
+func rejectedPath(stem, reason string) string {
+	return path.Join(config.RejectedPath, fmt.Sprintf("%s.%s", stem, reason))
+}